@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// buildTLSConfig returns the tls.Config the DoT listener should serve.
+// With -acme-domain set, certificates are obtained and renewed
+// automatically via ACME instead of a static -cert/-key pair: the
+// manager's GetCertificate hook answers TLS-ALPN-01 challenges
+// (RFC 8737) directly over the DoT listener, and, if -acme-http-addr is
+// set, a separate listener also answers HTTP-01 challenges.
+func buildTLSConfig(config *Config) (*tls.Config, error) {
+	if config.ACMEDomain == "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+		}, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomain),
+		Email:      config.ACMEEmail,
+	}
+	if config.ACMECA != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.ACMECA}
+	}
+
+	if config.ACMEHTTPAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(config.ACMEHTTPAddr, manager.HTTPHandler(nil)); err != nil {
+				logger.Error("ACME HTTP-01 challenge listener failed", "error", err)
+			}
+		}()
+	}
+
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	return tlsConfig, nil
+}
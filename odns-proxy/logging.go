@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// logger emits structured JSON logs so high-QPS deployments can ship
+// them straight to a log pipeline instead of scraping free-form text.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// fatal logs msg as an error and exits, mirroring the old log.Fatal(f)
+// behavior now that logging goes through a non-fatal structured logger.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// querySampler decides whether the Nth query should be logged, so
+// high-QPS deployments can log 1/N queries instead of every one.
+type querySampler struct {
+	rate    uint64
+	counter atomic.Uint64
+}
+
+// newQuerySampler builds a sampler that logs every rate-th query. A rate
+// below 1 logs every query.
+func newQuerySampler(rate int) *querySampler {
+	if rate < 1 {
+		rate = 1
+	}
+	return &querySampler{rate: uint64(rate)}
+}
+
+func (s *querySampler) shouldLog() bool {
+	n := s.counter.Add(1)
+	return (n-1)%s.rate == 0
+}
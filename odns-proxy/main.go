@@ -14,9 +14,10 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/circl/hpke"
@@ -30,6 +31,18 @@ const (
 	AeadID = hpke.AEAD_ChaCha20Poly1305
 )
 
+const (
+	// connIdleTimeout bounds how long a pipelined DoT connection may sit
+	// between queries before it is reaped.
+	connIdleTimeout = 2 * time.Minute
+	// maxInflightPerConn bounds concurrent in-flight queries on a single
+	// connection, so one misbehaving client can't unbound goroutine growth.
+	maxInflightPerConn = 256
+	// writeTimeout bounds how long a single response write may block, so
+	// a peer that stops reading can't leak the goroutine writing to it.
+	writeTimeout = 10 * time.Second
+)
+
 // Config holds proxy configuration
 type Config struct {
 	ListenAddr    string
@@ -38,12 +51,24 @@ type Config struct {
 	TLSCert       string
 	TLSKey        string
 	IPv6Only      bool
+	ConfigURL     string
+	MetricsListen string
+	LogSampleRate int
+	PaddingBlock  int
+	ACMEDomain    string
+	ACMEEmail     string
+	ACMECacheDir  string
+	ACMECA        string
+	ACMEHTTPAddr  string
 }
 
 // Proxy represents the oDNS proxy server
 type Proxy struct {
-	config *Config
-	suite  hpke.Suite
+	config    *Config
+	suite     hpke.Suite
+	keyStore  *keyStore
+	sampler   *querySampler
+	tlsConfig *tls.Config
 }
 
 // NewProxy creates a new oDNS proxy
@@ -53,40 +78,47 @@ func NewProxy(config *Config) (*Proxy, error) {
 		return nil, fmt.Errorf("failed to assemble HPKE suite: %w", err)
 	}
 
+	// Build the DoT certificate once, either from a static -cert/-key
+	// pair or, with -acme-domain set, via ACME autocert (renewed in the
+	// background). The metrics listener reuses the same tls.Config so
+	// -acme-domain deployments don't need a second certificate.
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build TLS config: %w", err)
+	}
+
 	return &Proxy{
-		config: config,
-		suite:  suite,
+		config:    config,
+		suite:     suite,
+		keyStore:  newKeyStore(config.HPKEPublicKey),
+		sampler:   newQuerySampler(config.LogSampleRate),
+		tlsConfig: tlsConfig,
 	}, nil
 }
 
+// TLSConfig returns the tls.Config the DoT listener serves, for reuse by
+// the metrics listener.
+func (p *Proxy) TLSConfig() *tls.Config {
+	return p.tlsConfig
+}
+
 // Start starts the proxy server
 func (p *Proxy) Start() error {
-	// Load TLS certificate
-	cert, err := tls.LoadX509KeyPair(p.config.TLSCert, p.config.TLSKey)
-	if err != nil {
-		return fmt.Errorf("failed to load TLS certificate: %w", err)
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS13, // TLS 1.3 only
-	}
-
 	// Listen on DNS over TLS (DoT) port 853
-	listener, err := tls.Listen("tcp", p.config.ListenAddr, tlsConfig)
+	listener, err := tls.Listen("tcp", p.config.ListenAddr, p.tlsConfig)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 	defer listener.Close()
 
-	log.Printf("oDNS Proxy listening on %s (DoT)", p.config.ListenAddr)
-	log.Printf("Forwarding to resolver: %s", p.config.ResolverAddr)
-	log.Printf("IPv6-only mode: %v", p.config.IPv6Only)
+	logger.Info("oDNS Proxy listening", "addr", p.config.ListenAddr, "transport", "DoT")
+	logger.Info("forwarding to resolver", "addr", p.config.ResolverAddr)
+	logger.Info("ipv6-only mode", "enabled", p.config.IPv6Only)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			logger.Error("accept error", "error", err)
 			continue
 		}
 
@@ -94,69 +126,97 @@ func (p *Proxy) Start() error {
 	}
 }
 
-// handleConnection handles a single DoT connection
+// handleConnection handles a single DoT connection. Real stub resolvers
+// keep the connection open and pipeline many queries over it, so we read
+// framed messages until the client disconnects, processing each query in
+// its own goroutine bounded by a semaphore. Responses may complete
+// out of order; writeFrame's mutex keeps them from interleaving on the
+// wire, and the DNS message ID lets the client match reply to query.
 func (p *Proxy) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Set connection deadline
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxInflightPerConn)
 
-	// Read DNS query (TCP format: 2-byte length + DNS message)
-	buf := make([]byte, 512)
-	n, err := conn.Read(buf)
-	if err != nil {
-		log.Printf("Read error: %v", err)
-		return
-	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
 
-	if n < 2 {
-		log.Printf("Invalid DNS message: too short")
-		return
+		dnsMsg, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error("read error", "error", err)
+			}
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(dnsMsg []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.handleQuery(conn, &writeMu, dnsMsg)
+		}(dnsMsg)
 	}
 
-	// Extract DNS message (skip 2-byte length prefix)
-	dnsMsg := buf[2:n]
+	wg.Wait()
+}
 
+// handleQuery encrypts and forwards a single DNS query, then writes the
+// response back on conn under writeMu.
+func (p *Proxy) handleQuery(conn net.Conn, writeMu *sync.Mutex, dnsMsg []byte) {
 	// Parse DNS query
 	msg := new(dns.Msg)
 	if err := msg.Unpack(dnsMsg); err != nil {
-		log.Printf("Failed to parse DNS message: %v", err)
+		logger.Error("failed to parse DNS message", "error", err)
 		return
 	}
 
 	// Log query (privacy-preserving: no client IP)
 	if len(msg.Question) > 0 {
-		log.Printf("Query: %s %s", msg.Question[0].Name, dns.TypeToString[msg.Question[0].Qtype])
+		qtype := dns.TypeToString[msg.Question[0].Qtype]
+		queriesTotal.WithLabelValues(qtype).Inc()
+		if p.sampler.shouldLog() {
+			logger.Info("query", "name", msg.Question[0].Name, "qtype", qtype)
+		}
+	}
+
+	// Strip ECS and pad to the configured block size before the query
+	// name length ever reaches the HPKE sealer.
+	sanitized, err := sanitizeForSeal(msg, p.config.PaddingBlock)
+	if err != nil {
+		logger.Error("failed to sanitize query", "error", err)
+		return
 	}
 
 	// Encrypt query with HPKE
-	encryptedQuery, err := p.encryptQuery(dnsMsg)
+	encryptedQuery, err := p.encryptQuery(sanitized)
 	if err != nil {
-		log.Printf("Encryption error: %v", err)
+		encryptionFailures.Inc()
+		logger.Error("encryption error", "error", err)
 		return
 	}
 
 	// Forward to resolver
 	response, err := p.forwardToResolver(encryptedQuery)
 	if err != nil {
-		log.Printf("Forward error: %v", err)
+		logger.Error("forward error", "error", err)
 		return
 	}
 
-	// Send response back to client
-	responseLen := make([]byte, 2)
-	responseLen[0] = byte(len(response) >> 8)
-	responseLen[1] = byte(len(response))
+	if reply := new(dns.Msg); reply.Unpack(response) == nil {
+		responsesTotal.WithLabelValues(dns.RcodeToString[reply.Rcode]).Inc()
+	}
 
-	if _, err := conn.Write(append(responseLen, response...)); err != nil {
-		log.Printf("Write error: %v", err)
+	if err := writeFrame(conn, writeMu, response); err != nil {
+		logger.Error("write error", "error", err)
 	}
 }
 
 // encryptQuery encrypts a DNS query using HPKE
 func (p *Proxy) encryptQuery(query []byte) ([]byte, error) {
-	// Unmarshal public key
-	pkR, err := p.suite.KEM.UnmarshalBinaryPublicKey(p.config.HPKEPublicKey)
+	// Unmarshal public key (may have been hot-swapped by watchConfigURL)
+	pkR, err := p.suite.KEM.UnmarshalBinaryPublicKey(p.keyStore.current())
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal public key: %w", err)
 	}
@@ -169,7 +229,9 @@ func (p *Proxy) encryptQuery(query []byte) ([]byte, error) {
 
 	// Encrypt query
 	// Format: encapsulated key || ciphertext
+	start := time.Now()
 	encapsulatedKey, ciphertext, err := sender.Seal(query, nil)
+	hpkeSealDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return nil, fmt.Errorf("HPKE seal failed: %w", err)
 	}
@@ -191,29 +253,18 @@ func (p *Proxy) forwardToResolver(encryptedQuery []byte) ([]byte, error) {
 
 	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	// Send encrypted query (TCP format: 2-byte length + payload)
-	queryLen := make([]byte, 2)
-	queryLen[0] = byte(len(encryptedQuery) >> 8)
-	queryLen[1] = byte(len(encryptedQuery))
-
-	if _, err := conn.Write(append(queryLen, encryptedQuery...)); err != nil {
+	// Send encrypted query (length-prefixed, same framing as the client side)
+	var writeMu sync.Mutex
+	if err := writeFrame(conn, &writeMu, encryptedQuery); err != nil {
 		return nil, fmt.Errorf("failed to send to resolver: %w", err)
 	}
 
 	// Read response
-	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
+	response, err := readFrame(conn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from resolver: %w", err)
 	}
 
-	if n < 2 {
-		return nil, fmt.Errorf("invalid response: too short")
-	}
-
-	// Extract response (skip 2-byte length prefix)
-	response := buf[2:n]
-
 	return response, nil
 }
 
@@ -258,34 +309,50 @@ func main() {
 	tlsKey := flag.String("key", "key.pem", "TLS private key file")
 	ipv6Only := flag.Bool("ipv6-only", false, "IPv6-only mode")
 	genKeys := flag.Bool("genkeys", false, "Generate HPKE key pair and exit")
+	configURL := flag.String("config-url", "", "ODoHConfigs URL (RFC 9230) to periodically fetch the resolver's HPKE public key from, e.g. https://resolver:8443/.well-known/odohconfigs")
+	configFetchInterval := flag.Duration("config-fetch-interval", 5*time.Minute, "How often to re-fetch -config-url")
+	metricsListen := flag.String("metrics-listen", "", "Serve Prometheus metrics over HTTPS on this address, e.g. :9853")
+	logSampleRate := flag.Int("log-sample", 1, "Log only 1 in every N queries (1 logs every query)")
+	paddingBlock := flag.Int("padding-block", defaultPaddingBlock, "Pad queries to a multiple of this many bytes before sealing (RFC 7830/8467); 0 disables padding")
+	acmeDomain := flag.String("acme-domain", "", "Domain to obtain a DoT certificate for via ACME (replaces -cert/-key)")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the ACME account")
+	acmeCacheDir := flag.String("acme-cache", "acme-cache", "Directory to cache ACME account keys and certificates in")
+	acmeCA := flag.String("acme-ca", "", "ACME directory URL override, e.g. Let's Encrypt staging (default: Let's Encrypt production)")
+	acmeHTTPAddr := flag.String("acme-http-addr", "", "Also answer ACME HTTP-01 challenges on this address (TLS-ALPN-01 over -listen stays enabled)")
 
 	flag.Parse()
 
 	// Generate keys if requested
 	if *genKeys {
 		if err := generateHPKEKeys(); err != nil {
-			log.Fatalf("Key generation failed: %v", err)
+			fatal("key generation failed", "error", err)
 		}
 		return
 	}
 
 	// Validate required parameters
-	if *pubkey == "" {
-		log.Fatal("HPKE public key required (use -pubkey or -genkeys)")
+	if *pubkey == "" && *configURL == "" {
+		fatal("HPKE public key required (use -pubkey, -config-url, or -genkeys)")
 	}
 
 	// Decode public key
-	pubkeyBytes, err := base64.StdEncoding.DecodeString(*pubkey)
-	if err != nil {
-		log.Fatalf("Invalid public key: %v", err)
+	var pubkeyBytes []byte
+	if *pubkey != "" {
+		var err error
+		pubkeyBytes, err = base64.StdEncoding.DecodeString(*pubkey)
+		if err != nil {
+			fatal("invalid public key", "error", err)
+		}
 	}
 
-	// Check TLS certificate exists
-	if _, err := os.Stat(*tlsCert); os.IsNotExist(err) {
-		log.Fatalf("TLS certificate not found: %s", *tlsCert)
-	}
-	if _, err := os.Stat(*tlsKey); os.IsNotExist(err) {
-		log.Fatalf("TLS private key not found: %s", *tlsKey)
+	// Check TLS certificate exists, unless ACME will provision one
+	if *acmeDomain == "" {
+		if _, err := os.Stat(*tlsCert); os.IsNotExist(err) {
+			fatal("TLS certificate not found", "path", *tlsCert)
+		}
+		if _, err := os.Stat(*tlsKey); os.IsNotExist(err) {
+			fatal("TLS private key not found", "path", *tlsKey)
+		}
 	}
 
 	// Create proxy configuration
@@ -296,15 +363,43 @@ func main() {
 		TLSCert:       *tlsCert,
 		TLSKey:        *tlsKey,
 		IPv6Only:      *ipv6Only,
+		ConfigURL:     *configURL,
+		MetricsListen: *metricsListen,
+		LogSampleRate: *logSampleRate,
+		PaddingBlock:  *paddingBlock,
+		ACMEDomain:    *acmeDomain,
+		ACMEEmail:     *acmeEmail,
+		ACMECacheDir:  *acmeCacheDir,
+		ACMECA:        *acmeCA,
+		ACMEHTTPAddr:  *acmeHTTPAddr,
 	}
 
 	// Create and start proxy
 	proxy, err := NewProxy(config)
 	if err != nil {
-		log.Fatalf("Failed to create proxy: %v", err)
+		fatal("failed to create proxy", "error", err)
+	}
+
+	if config.ConfigURL != "" {
+		if config.HPKEPublicKey == nil {
+			// No static key was given: block on a first fetch so we
+			// have something to encrypt with before accepting queries.
+			if err := proxy.fetchAndApplyConfig(config.ConfigURL); err != nil {
+				fatal("initial ODoHConfigs fetch failed", "error", err)
+			}
+		}
+		go proxy.watchConfigURL(config.ConfigURL, *configFetchInterval)
+	}
+
+	if config.MetricsListen != "" {
+		go func() {
+			if err := startMetricsListener(config.MetricsListen, proxy.TLSConfig()); err != nil {
+				fatal("metrics listener error", "error", err)
+			}
+		}()
 	}
 
 	if err := proxy.Start(); err != nil {
-		log.Fatalf("Proxy error: %v", err)
+		fatal("proxy error", "error", err)
 	}
 }
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics carry no client-identifying label (no client IP, no
+// per-connection ID) so the access log path stays as privacy-preserving
+// as the query log it's derived from.
+var (
+	hpkeSealDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "odns_proxy_hpke_seal_duration_seconds",
+		Help: "Time spent HPKE-sealing a query before forwarding to the resolver.",
+	})
+	encryptionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odns_proxy_encryption_failures_total",
+		Help: "Queries that failed to HPKE-seal.",
+	})
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "odns_proxy_queries_total",
+		Help: "Queries processed, by query type.",
+	}, []string{"qtype"})
+	responsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "odns_proxy_responses_total",
+		Help: "Responses returned, by response code.",
+	}, []string{"rcode"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "odns_proxy_goroutines",
+		Help: "Current number of goroutines.",
+	}, func() float64 { return float64(runtime.NumGoroutine()) })
+)
+
+// startMetricsListener serves Prometheus metrics over HTTPS on
+// listenAddr, using tlsConfig — the same tls.Config the DoT listener
+// serves, static or ACME-provisioned, so -acme-domain deployments don't
+// need a second certificate just for metrics.
+func startMetricsListener(listenAddr string, tlsConfig *tls.Config) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:      listenAddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	logger.Info("metrics listener starting", "addr", listenAddr)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// odohConfigVersion is the ObliviousDoHConfig.version we accept
+	// (RFC 9230 section 4.1).
+	odohConfigVersion = 0x0001
+	// maxKeyEpochHistory bounds how many past epochs we retain for
+	// observability; only the newest is ever used to encrypt.
+	maxKeyEpochHistory = 4
+)
+
+// odohConfigEntry is one parsed ObliviousDoHConfig entry.
+type odohConfigEntry struct {
+	KemID     uint16
+	KdfID     uint16
+	AeadID    uint16
+	PublicKey []byte
+}
+
+// parseODoHConfigs parses the RFC 9230 section 4.1 ObliviousDoHConfigs
+// wire format: a 2-byte total length followed by one ObliviousDoHConfig
+// (version, length, contents) per entry, where contents is
+// (kem_id, kdf_id, aead_id, public_key<0..2^16-1>).
+func parseODoHConfigs(data []byte) ([]odohConfigEntry, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("odohconfigs: truncated length")
+	}
+
+	total := binary.BigEndian.Uint16(data[:2])
+	body := data[2:]
+	if len(body) < int(total) {
+		return nil, fmt.Errorf("odohconfigs: truncated body")
+	}
+	body = body[:total]
+
+	var configs []odohConfigEntry
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return nil, fmt.Errorf("odohconfigs: truncated config header")
+		}
+		version := binary.BigEndian.Uint16(body[:2])
+		length := binary.BigEndian.Uint16(body[2:4])
+		body = body[4:]
+		if len(body) < int(length) {
+			return nil, fmt.Errorf("odohconfigs: truncated config contents")
+		}
+		contents := body[:length]
+		body = body[length:]
+
+		if version != odohConfigVersion {
+			continue // skip configs for versions we don't understand
+		}
+		if len(contents) < 8 {
+			return nil, fmt.Errorf("odohconfigs: truncated contents")
+		}
+
+		kemID := binary.BigEndian.Uint16(contents[0:2])
+		kdfID := binary.BigEndian.Uint16(contents[2:4])
+		aeadID := binary.BigEndian.Uint16(contents[4:6])
+		pkLen := binary.BigEndian.Uint16(contents[6:8])
+		pubKey := contents[8:]
+		if len(pubKey) != int(pkLen) {
+			return nil, fmt.Errorf("odohconfigs: public key length mismatch")
+		}
+
+		configs = append(configs, odohConfigEntry{
+			KemID:     kemID,
+			KdfID:     kdfID,
+			AeadID:    aeadID,
+			PublicKey: append([]byte(nil), pubKey...),
+		})
+	}
+
+	return configs, nil
+}
+
+// pubKeyEpoch is one (epoch, public key) pair fetched from the
+// resolver's ODoHConfigs endpoint.
+type pubKeyEpoch struct {
+	Epoch     uint64
+	PublicKey []byte
+	FetchedAt time.Time
+}
+
+// keyStore holds the HPKE public key the proxy currently encrypts to. It
+// is hot-swappable from a background ODoHConfigs fetch: encryptQuery
+// reads an immutable snapshot via current(), so a rotation never
+// disturbs a query already in flight.
+type keyStore struct {
+	mu      sync.RWMutex
+	history []pubKeyEpoch // newest first
+}
+
+// newKeyStore seeds a keyStore with the statically-configured public key
+// as epoch 0.
+func newKeyStore(initial []byte) *keyStore {
+	return &keyStore{history: []pubKeyEpoch{{PublicKey: initial, FetchedAt: time.Now()}}}
+}
+
+// current returns the public key currently used to encrypt queries.
+func (s *keyStore) current() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.history[0].PublicKey
+}
+
+// update hot-swaps in a newly-fetched public key, a no-op if it matches
+// the one already current.
+func (s *keyStore) update(pubKey []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bytes.Equal(s.history[0].PublicKey, pubKey) {
+		return
+	}
+
+	entry := pubKeyEpoch{Epoch: s.history[0].Epoch + 1, PublicKey: pubKey, FetchedAt: time.Now()}
+	s.history = append([]pubKeyEpoch{entry}, s.history...)
+	if len(s.history) > maxKeyEpochHistory {
+		s.history = s.history[:maxKeyEpochHistory]
+	}
+
+	logger.Info("HPKE public key rotated", "epoch", entry.Epoch)
+}
+
+// watchConfigURL periodically fetches ODoHConfigs from configURL and
+// hot-swaps the proxy's HPKE public key when the resolver has rotated.
+func (p *Proxy) watchConfigURL(configURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.fetchAndApplyConfig(configURL); err != nil {
+			logger.Error("ODoHConfigs fetch failed", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// fetchAndApplyConfig fetches and parses ODoHConfigs from configURL over
+// HTTPS (the standard library validates the server certificate unless
+// explicitly told not to, which we never do), then swaps in the entry
+// matching our configured HPKE suite.
+func (p *Proxy) fetchAndApplyConfig(configURL string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS13},
+		},
+	}
+
+	resp, err := client.Get(configURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch odohconfigs: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching odohconfigs: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read odohconfigs: %w", err)
+	}
+
+	configs, err := parseODoHConfigs(body)
+	if err != nil {
+		return fmt.Errorf("failed to parse odohconfigs: %w", err)
+	}
+
+	for _, c := range configs {
+		if c.KemID == uint16(KemID) && c.KdfID == uint16(KdfID) && c.AeadID == uint16(AeadID) {
+			p.keyStore.update(c.PublicKey)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no odohconfigs entry matches configured HPKE suite")
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import "github.com/miekg/dns"
+
+// defaultPaddingBlock is the EDNS(0) padding block size (RFC 8467's
+// recommended policy) applied before HPKE sealing, absent -padding-block.
+const defaultPaddingBlock = 128
+
+// sanitizeForSeal strips client-subnet ECS (it would re-introduce client
+// location to the resolver, defeating the privacy model) and, if
+// blockSize > 0, pads msg with EDNS(0) padding (RFC 7830) so the sealed
+// ciphertext length doesn't leak the query name length. It returns the
+// wire-format bytes to pass to encryptQuery.
+func sanitizeForSeal(msg *dns.Msg, blockSize int) ([]byte, error) {
+	stripECS(msg)
+
+	if blockSize <= 0 {
+		return msg.Pack()
+	}
+
+	return padToBlock(msg, blockSize)
+}
+
+// stripECS removes any EDNS(0) Client Subnet option (RFC 7871, option
+// code 8) from msg's OPT record, if present.
+func stripECS(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+// padToBlock adds (or replaces) an EDNS(0) padding option (RFC 7830,
+// option code 12) on msg's OPT record so the packed message length is a
+// multiple of blockSize, per the block-length padding policy recommended
+// in RFC 8467. It creates an OPT record via SetEdns0 if msg doesn't
+// already have one.
+func padToBlock(msg *dns.Msg, blockSize int) ([]byte, error) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			kept = append(kept, o)
+		}
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(kept, padding)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if remainder := len(packed) % blockSize; remainder != 0 {
+		padding.Padding = make([]byte, blockSize-remainder)
+		packed, err = msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return packed, nil
+}
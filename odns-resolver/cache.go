@@ -0,0 +1,355 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"container/list"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/miekg/dns"
+)
+
+// prefetchSweepInterval is how often the prefetch loop scans for entries
+// nearing expiry.
+const prefetchSweepInterval = 10 * time.Second
+
+// cacheKey identifies a cached answer. DO is part of the key (not just
+// qname/qtype/qclass) because a DO=1 response carries RRSIGs a DO=0
+// response doesn't, so the two must never be served in place of one
+// another.
+type cacheKey struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+}
+
+// Cache is the interface the resolver's DNS response cache implements.
+// Implementations regenerate an answer's TTLs and message ID on every
+// Get rather than replaying the raw stored bytes, so cached answers
+// never leak which earlier query populated the entry.
+type Cache interface {
+	// Get returns a reply to req, synthesized from a fresh cache hit
+	// with TTLs adjusted for time elapsed since insertion, or
+	// (nil, false) on a miss.
+	Get(req *dns.Msg) (*dns.Msg, bool)
+	// Set stores resp (the upstream answer to req) in the cache.
+	Set(req *dns.Msg, resp *dns.Msg)
+}
+
+// cacheEntry is one cached answer.
+type cacheEntry struct {
+	msg        *dns.Msg // answer as received from upstream, TTLs as-of insertedAt
+	insertedAt time.Time
+	ttl        time.Duration
+	lastAccess time.Time
+}
+
+type lruItem struct {
+	key   cacheKey
+	entry *cacheEntry
+}
+
+// lruShard is one shard of the sharded LRU cache.
+type lruShard struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[cacheKey]*list.Element
+	order    *list.List // front = most recently used
+}
+
+func newLRUShard(capacity int) *lruShard {
+	return &lruShard{
+		capacity: capacity,
+		items:    make(map[cacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (s *lruShard) get(key cacheKey) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*lruItem).entry
+	if time.Since(entry.insertedAt) >= entry.ttl {
+		s.order.Remove(el)
+		delete(s.items, key)
+		return nil, false
+	}
+
+	entry.lastAccess = time.Now()
+	s.order.MoveToFront(el)
+	return entry, true
+}
+
+func (s *lruShard) set(key cacheKey, entry *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		// Keep the old lastAccess: a prefetch refresh is not a client
+		// query and must not extend the prefetch window.
+		entry.lastAccess = el.Value.(*lruItem).entry.lastAccess
+		el.Value.(*lruItem).entry = entry
+		s.order.MoveToFront(el)
+		return
+	}
+
+	el := s.order.PushFront(&lruItem{key: key, entry: entry})
+	s.items[key] = el
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		if oldest == nil {
+			break
+		}
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*lruItem).key)
+	}
+}
+
+// forEach calls fn for every live entry, used by the prefetch sweep.
+func (s *lruShard) forEach(fn func(key cacheKey, entry *cacheEntry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, el := range s.items {
+		fn(key, el.Value.(*lruItem).entry)
+	}
+}
+
+// RefreshFunc re-resolves a cache key against upstream, typically storing
+// the fresh answer back into the cache via Set. do must be passed through
+// unchanged from the cache key being refreshed: it's part of the key, and
+// a refresh that drops it would cache the fresh answer under a different
+// key than the hot entry it was meant to replace.
+type RefreshFunc func(name string, qtype, qclass uint16, do bool)
+
+// ShardedLRUCache is the default in-memory Cache, sharded by
+// xxhash(qname) to reduce lock contention across shards, with TTL-aware
+// eviction, RFC 2308 negative caching, and optional prefetch of hot
+// entries before they expire.
+type ShardedLRUCache struct {
+	shards []*lruShard
+	minTTL time.Duration
+	maxTTL time.Duration
+
+	prefetchMargin time.Duration
+	prefetchWindow time.Duration
+	refresh        RefreshFunc
+}
+
+// NewShardedLRUCache creates a cache of numShards shards, each holding up
+// to capacityPerShard entries, clamping all stored TTLs to [minTTL, maxTTL].
+func NewShardedLRUCache(numShards, capacityPerShard int, minTTL, maxTTL time.Duration) *ShardedLRUCache {
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	shards := make([]*lruShard, numShards)
+	for i := range shards {
+		shards[i] = newLRUShard(capacityPerShard)
+	}
+
+	return &ShardedLRUCache{
+		shards: shards,
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+	}
+}
+
+// EnablePrefetch turns on background refresh of entries whose remaining
+// TTL drops below margin, provided they were queried within window.
+func (c *ShardedLRUCache) EnablePrefetch(margin, window time.Duration, refresh RefreshFunc) {
+	c.prefetchMargin = margin
+	c.prefetchWindow = window
+	c.refresh = refresh
+	go c.prefetchLoop()
+}
+
+func (c *ShardedLRUCache) shardFor(name string) *lruShard {
+	h := xxhash.Sum64String(strings.ToLower(name))
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+func cacheKeyFor(req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return cacheKey{Name: strings.ToLower(q.Name), Qtype: q.Qtype, Qclass: q.Qclass, DO: do}
+}
+
+// Get implements Cache. Queries with the CD (checking disabled) bit set
+// bypass the cache entirely: we have no way to know whether a cached
+// entry was produced by an upstream that validated DNSSEC, so a client
+// explicitly asking to skip that validation must always go upstream.
+func (c *ShardedLRUCache) Get(req *dns.Msg) (*dns.Msg, bool) {
+	if len(req.Question) != 1 || req.CheckingDisabled {
+		return nil, false
+	}
+
+	key := cacheKeyFor(req)
+	entry, ok := c.shardFor(key.Name).get(key)
+	if !ok {
+		return nil, false
+	}
+
+	return synthesizeFromCache(req, entry), true
+}
+
+// Set implements Cache.
+func (c *ShardedLRUCache) Set(req *dns.Msg, resp *dns.Msg) {
+	if len(req.Question) != 1 || req.CheckingDisabled {
+		return
+	}
+
+	ttl, ok := cacheableTTL(resp)
+	if !ok {
+		return
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	key := cacheKeyFor(req)
+	entry := &cacheEntry{
+		msg:        resp.Copy(),
+		insertedAt: time.Now(),
+		ttl:        ttl,
+		lastAccess: time.Now(),
+	}
+	c.shardFor(key.Name).set(key, entry)
+}
+
+// synthesizeFromCache builds a reply to req from a cache hit, regenerating
+// the message ID and decrementing every RR's TTL (other than the OPT
+// pseudo-RR's) by the time elapsed since insertion so a long-lived cache
+// entry never overstates freshness.
+func synthesizeFromCache(req *dns.Msg, entry *cacheEntry) *dns.Msg {
+	elapsed := uint32(time.Since(entry.insertedAt).Seconds())
+
+	reply := entry.msg.Copy()
+	reply.SetReply(req)
+	reply.Rcode = entry.msg.Rcode
+	reply.Answer = decrementTTLs(entry.msg.Answer, elapsed)
+	reply.Ns = decrementTTLs(entry.msg.Ns, elapsed)
+	reply.Extra = decrementTTLs(entry.msg.Extra, elapsed)
+
+	return reply
+}
+
+func decrementTTLs(rrs []dns.RR, elapsed uint32) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		cp := dns.Copy(rr)
+		if cp.Header().Rrtype == dns.TypeOPT {
+			out[i] = cp // pseudo-RR: its TTL field holds EDNS flags, not a TTL
+			continue
+		}
+		if cp.Header().Ttl > elapsed {
+			cp.Header().Ttl -= elapsed
+		} else {
+			cp.Header().Ttl = 0
+		}
+		out[i] = cp
+	}
+	return out
+}
+
+// cacheableTTL determines the TTL a response should be cached for,
+// implementing the minimum-TTL-across-sections rule for positive answers
+// and the RFC 2308 SOA-MINIMUM ceiling for negative ones. ok is false for
+// responses that carry no TTL information to cache against (e.g. SERVFAIL).
+func cacheableTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0) {
+		return negativeTTL(resp)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+	return positiveTTL(resp)
+}
+
+// positiveTTL returns the minimum TTL across the answer, authority, and
+// additional sections.
+func positiveTTL(resp *dns.Msg) (time.Duration, bool) {
+	var min uint32 = math.MaxUint32
+	found := false
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue // pseudo-RR, not a real TTL
+			}
+			if rr.Header().Ttl < min {
+				min = rr.Header().Ttl
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+	return time.Duration(min) * time.Second, true
+}
+
+// negativeTTL implements RFC 2308 section 5: the ceiling for caching
+// NXDOMAIN/NODATA is the minimum of the SOA's MINIMUM field and the SOA
+// record's own TTL.
+func negativeTTL(resp *dns.Msg) (time.Duration, bool) {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
+}
+
+// prefetchLoop periodically refreshes hot entries before they expire.
+func (c *ShardedLRUCache) prefetchLoop() {
+	ticker := time.NewTicker(prefetchSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, shard := range c.shards {
+			shard.forEach(func(key cacheKey, entry *cacheEntry) {
+				remaining := entry.ttl - time.Since(entry.insertedAt)
+				if remaining <= 0 || remaining > c.prefetchMargin {
+					return
+				}
+				if now.Sub(entry.lastAccess) > c.prefetchWindow {
+					return
+				}
+				go c.refresh(key.Name, key.Qtype, key.Qclass, key.DO)
+			})
+		}
+	}
+}
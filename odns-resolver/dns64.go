@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDNS64Prefix is the Well-Known Prefix for NAT64/DNS64 synthesis
+// defined in RFC 6052 / RFC 6147.
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// dns64Synthesizer synthesizes AAAA records from A records per RFC 6147,
+// embedding the IPv4 address into the low 32 bits of a configured /96
+// IPv6 prefix.
+type dns64Synthesizer struct {
+	prefix  [12]byte
+	exclude []string
+}
+
+// newDNS64Synthesizer builds a synthesizer from a CIDR string (must be a
+// /96) and a list of AAAA suffixes (names under which native IPv6 is
+// expected, so synthesis is bypassed).
+func newDNS64Synthesizer(prefixCIDR string, exclude []string) (*dns64Synthesizer, error) {
+	ip, ipNet, err := net.ParseCIDR(prefixCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns64 prefix %q: %w", prefixCIDR, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 128 || ones != 96 {
+		return nil, fmt.Errorf("dns64 prefix %q must be a /96", prefixCIDR)
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil, fmt.Errorf("dns64 prefix %q is not a valid IPv6 address", prefixCIDR)
+	}
+
+	normalized := make([]string, len(exclude))
+	for i, suffix := range exclude {
+		normalized[i] = strings.ToLower(dns.Fqdn(suffix))
+	}
+
+	s := &dns64Synthesizer{exclude: normalized}
+	copy(s.prefix[:], ip16[:12])
+	return s, nil
+}
+
+// excluded reports whether qname is equal to, or a subdomain of, one of
+// the configured no-dns64-exclude suffixes and should bypass synthesis.
+// Matching is on label boundaries, so "example.com." excludes
+// "www.example.com." but not "evilexample.com.".
+func (d *dns64Synthesizer) excluded(qname string) bool {
+	qname = strings.ToLower(qname)
+	for _, suffix := range d.exclude {
+		if qname == suffix || strings.HasSuffix(qname, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesize embeds ipv4 into the configured /96 prefix, producing the
+// IPv6 address a DNS64-aware AAAA answer should carry.
+func (d *dns64Synthesizer) synthesize(ipv4 net.IP) net.IP {
+	v4 := ipv4.To4()
+	if v4 == nil {
+		return nil
+	}
+
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized[:12], d.prefix[:])
+	copy(synthesized[12:], v4)
+	return synthesized
+}
+
+// resolveWithDNS64 answers an AAAA query, synthesizing the response from
+// upstream A records when upstream has no native AAAA data (RFC 6147).
+// The AD bit is cleared only on a synthesized reply, since that's the
+// only case where the answer no longer matches what upstream actually
+// signed; genuine pass-through (native IPv6, NXDOMAIN, or NODATA with no
+// A record either) keeps upstream's own AD bit.
+func (r *Resolver) resolveWithDNS64(query *dns.Msg) (*dns.Msg, error) {
+	native, err := r.upstream.exchange(query)
+	if err != nil {
+		return nil, fmt.Errorf("upstream DNS error: %w", err)
+	}
+
+	if native.Rcode != dns.RcodeSuccess || len(native.Answer) > 0 {
+		// Either an error (e.g. NXDOMAIN) or native IPv6 already exists:
+		// pass the upstream answer through unmodified.
+		return native, nil
+	}
+
+	aQuery := query.Copy()
+	aQuery.Question[0].Qtype = dns.TypeA
+
+	aResp, err := r.upstream.exchange(aQuery)
+	if err != nil {
+		return nil, fmt.Errorf("upstream DNS64 A lookup error: %w", err)
+	}
+	if aResp.Rcode != dns.RcodeSuccess || len(aResp.Answer) == 0 {
+		// No A record to synthesize from either; return the original NODATA.
+		return native, nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Rcode = dns.RcodeSuccess
+	reply.AuthenticatedData = false
+
+	for _, rr := range aResp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		synthesized := r.config.DNS64.synthesize(a.A)
+		if synthesized == nil {
+			continue
+		}
+		reply.Answer = append(reply.Answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   query.Question[0].Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    a.Hdr.Ttl,
+			},
+			AAAA: synthesized,
+		})
+	}
+
+	return reply, nil
+}
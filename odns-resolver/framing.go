@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrameSize is the largest DNS message a 2-byte TCP length prefix can
+// address (RFC 1035 section 4.2.2).
+const maxFrameSize = 0xffff
+
+// readFrame reads a single 2-byte-length-prefixed message from r, the
+// framing used by DNS over TCP/TLS (RFC 7766). It returns io.EOF (or the
+// underlying read error) when the connection has nothing left to give,
+// so callers can tell a clean session close from a wire-format fault.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(lenBuf[0])<<8 | int(lenBuf[1])
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("short frame body: %w", err)
+	}
+
+	return buf, nil
+}
+
+// writeFrame writes payload to conn with a 2-byte length prefix, guarded
+// by mu so that concurrently-processed, out-of-order responses never
+// interleave their bytes on the wire (the DNS message ID already lets
+// the proxy match replies to queries). It sets a write deadline before
+// writing so a peer that stops reading (dead NAT mapping, TCP
+// backpressure) can't block the writer goroutine forever.
+func writeFrame(conn net.Conn, mu *sync.Mutex, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+
+	frame := make([]byte, 2+len(payload))
+	frame[0] = byte(len(payload) >> 8)
+	frame[1] = byte(len(payload))
+	copy(frame[2:], payload)
+
+	mu.Lock()
+	defer mu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(frame)
+	return err
+}
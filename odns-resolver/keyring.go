@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+)
+
+// keyRingEntry is one HPKE key pair the resolver can currently decrypt
+// queries with.
+type keyRingEntry struct {
+	Epoch      uint64
+	PublicKey  []byte
+	PrivateKey []byte
+	CreatedAt  time.Time
+}
+
+// keyRing holds the resolver's current HPKE key plus any keys still
+// inside the post-rotation grace window, so queries encrypted under a
+// key that was just rotated out still decrypt for graceWindow after
+// rotation (per the ODoHConfigs key handoff in RFC 9230 section 5).
+type keyRing struct {
+	suite       hpke.Suite
+	graceWindow time.Duration
+
+	mu        sync.RWMutex
+	entries   []keyRingEntry // newest first
+	nextEpoch uint64
+}
+
+// newKeyRing seeds a keyRing with privKey as epoch 0.
+func newKeyRing(suite hpke.Suite, privKey []byte, graceWindow time.Duration) (*keyRing, error) {
+	entry, err := deriveKeyRingEntry(suite, privKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyRing{
+		suite:       suite,
+		graceWindow: graceWindow,
+		entries:     []keyRingEntry{entry},
+		nextEpoch:   1,
+	}, nil
+}
+
+// deriveKeyRingEntry derives the public key for privKey and wraps both in
+// a keyRingEntry at the given epoch.
+func deriveKeyRingEntry(suite hpke.Suite, privKey []byte, epoch uint64) (keyRingEntry, error) {
+	skR, err := suite.KEM.UnmarshalBinaryPrivateKey(privKey)
+	if err != nil {
+		return keyRingEntry{}, fmt.Errorf("failed to unmarshal private key: %w", err)
+	}
+
+	pubKey, err := skR.Public().MarshalBinary()
+	if err != nil {
+		return keyRingEntry{}, fmt.Errorf("failed to derive public key: %w", err)
+	}
+
+	return keyRingEntry{
+		Epoch:      epoch,
+		PublicKey:  pubKey,
+		PrivateKey: privKey,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// rotate generates a fresh HPKE key pair, makes it current, and expires
+// any prior entries that have aged out of the grace window.
+func (kr *keyRing) rotate() (keyRingEntry, error) {
+	publicKey, privateKey, err := kr.suite.KEM.GenerateKeyPair()
+	if err != nil {
+		return keyRingEntry{}, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	pkBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		return keyRingEntry{}, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	skBytes, err := privateKey.MarshalBinary()
+	if err != nil {
+		return keyRingEntry{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	entry := keyRingEntry{
+		Epoch:      kr.nextEpoch,
+		PublicKey:  pkBytes,
+		PrivateKey: skBytes,
+		CreatedAt:  time.Now(),
+	}
+	kr.nextEpoch++
+	kr.entries = append([]keyRingEntry{entry}, kr.entries...)
+	kr.expireLocked()
+
+	return entry, nil
+}
+
+// expireLocked drops rotated-out entries whose grace window has passed,
+// always keeping the current (newest) entry. An entry's grace window
+// starts when the next newer entry replaced it, not when it was created.
+// It runs on each rotation, so a rotated-out key is dropped at the first
+// rotation after its grace window has passed. Callers must hold kr.mu.
+func (kr *keyRing) expireLocked() {
+	if len(kr.entries) <= 1 {
+		return
+	}
+
+	cutoff := time.Now().Add(-kr.graceWindow)
+	kept := kr.entries[:1]
+	for i, e := range kr.entries[1:] {
+		// kr.entries[i] is the entry that replaced e.
+		if kr.entries[i].CreatedAt.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	kr.entries = kept
+}
+
+// snapshot returns a copy of the current entries, newest first.
+func (kr *keyRing) snapshot() []keyRingEntry {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	out := make([]keyRingEntry, len(kr.entries))
+	copy(out, kr.entries)
+	return out
+}
@@ -13,9 +13,10 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/circl/hpke"
@@ -29,18 +30,56 @@ const (
 	AeadID = hpke.AEAD_ChaCha20Poly1305
 )
 
+const (
+	// connIdleTimeout bounds how long a pipelined connection from the
+	// proxy may sit between queries before it is reaped.
+	connIdleTimeout = 2 * time.Minute
+	// maxInflightPerConn bounds concurrent in-flight queries on a single
+	// connection, so one misbehaving proxy can't unbound goroutine growth.
+	maxInflightPerConn = 256
+	// writeTimeout bounds how long a single response write may block, so
+	// a peer that stops reading can't leak the goroutine writing to it.
+	writeTimeout = 10 * time.Second
+
+	// cacheShardCount is the number of shards the response cache is split
+	// into to reduce lock contention.
+	cacheShardCount = 16
+	// prefetchMargin triggers an asynchronous refresh once an entry's
+	// remaining TTL drops below this.
+	prefetchMargin = 10 * time.Second
+	// prefetchWindow only prefetches entries that were actually queried
+	// within this long ago, so prefetch load scales with popularity.
+	prefetchWindow = 5 * time.Minute
+)
+
 // Config holds resolver configuration
 type Config struct {
 	ListenAddr     string
 	UpstreamDNS    string
 	HPKEPrivateKey []byte
+	DNS64          *dns64Synthesizer
+	KeyGraceWindow time.Duration
+	ConfigListen   string
+	ConfigCert     string
+	ConfigKey      string
+	CacheSize      int
+	CacheMinTTL    time.Duration
+	CacheMaxTTL    time.Duration
+	Prefetch       bool
+	MetricsListen  string
+	MetricsCert    string
+	MetricsKey     string
+	LogSampleRate  int
 }
 
 // Resolver represents the oDNS resolver server
 type Resolver struct {
-	config *Config
-	suite  hpke.Suite
-	client *dns.Client
+	config   *Config
+	suite    hpke.Suite
+	upstream *upstreamPool
+	keyRing  *keyRing
+	cache    Cache
+	sampler  *querySampler
 }
 
 // NewResolver creates a new oDNS resolver
@@ -50,14 +89,35 @@ func NewResolver(config *Config) (*Resolver, error) {
 		return nil, fmt.Errorf("failed to assemble HPKE suite: %w", err)
 	}
 
-	return &Resolver{
-		config: config,
-		suite:  suite,
-		client: &dns.Client{
-			Net:     "udp",
-			Timeout: 5 * time.Second,
-		},
-	}, nil
+	ring, err := newKeyRing(suite, config.HPKEPrivateKey, config.KeyGraceWindow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize key ring: %w", err)
+	}
+
+	r := &Resolver{
+		config:   config,
+		suite:    suite,
+		upstream: newUpstreamPool(config.UpstreamDNS, 5*time.Second),
+		keyRing:  ring,
+		sampler:  newQuerySampler(config.LogSampleRate),
+	}
+
+	if config.CacheSize > 0 {
+		// Integer division can floor to 0 for a -cache-size smaller than
+		// cacheShardCount; clamp so every shard can hold at least one
+		// entry instead of silently evicting everything it caches.
+		capacityPerShard := config.CacheSize / cacheShardCount
+		if capacityPerShard < 1 {
+			capacityPerShard = 1
+		}
+		lru := NewShardedLRUCache(cacheShardCount, capacityPerShard, config.CacheMinTTL, config.CacheMaxTTL)
+		if config.Prefetch {
+			lru.EnablePrefetch(prefetchMargin, prefetchWindow, r.refreshCache)
+		}
+		r.cache = lru
+	}
+
+	return r, nil
 }
 
 // Start starts the resolver server
@@ -68,14 +128,14 @@ func (r *Resolver) Start() error {
 	}
 	defer listener.Close()
 
-	log.Printf("oDNS Resolver listening on %s", r.config.ListenAddr)
-	log.Printf("Upstream DNS: %s", r.config.UpstreamDNS)
-	log.Println("Privacy mode: Client IPs not logged")
+	logger.Info("oDNS Resolver listening", "addr", r.config.ListenAddr)
+	logger.Info("upstream DNS", "addr", r.config.UpstreamDNS)
+	logger.Info("privacy mode: client IPs not logged")
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			logger.Error("accept error", "error", err)
 			continue
 		}
 
@@ -83,74 +143,91 @@ func (r *Resolver) Start() error {
 	}
 }
 
-// handleConnection handles a single connection from proxy
+// handleConnection handles a single connection from the proxy. The proxy
+// pipelines many queries over one connection, so we read framed messages
+// until it disconnects, processing each in its own goroutine bounded by a
+// semaphore, and serialize writes so concurrently-completed (possibly
+// out-of-order) responses don't interleave on the wire.
 func (r *Resolver) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxInflightPerConn)
 
-	// Read encrypted DNS query
-	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
-	if err != nil {
-		log.Printf("Read error: %v", err)
-		return
-	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
 
-	if n < 2 {
-		log.Printf("Invalid message: too short")
-		return
+		encryptedQuery, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error("read error", "error", err)
+			}
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(encryptedQuery []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.handleQuery(conn, &writeMu, encryptedQuery)
+		}(encryptedQuery)
 	}
 
-	// Extract encrypted query (skip 2-byte length prefix)
-	encryptedQuery := buf[2:n]
+	wg.Wait()
+}
 
+// handleQuery decrypts, resolves, and answers a single encrypted query,
+// writing the response back on conn under writeMu.
+func (r *Resolver) handleQuery(conn net.Conn, writeMu *sync.Mutex, encryptedQuery []byte) {
 	// Decrypt query
+	start := time.Now()
 	dnsQuery, err := r.decryptQuery(encryptedQuery)
+	hpkeOpenDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Printf("Decryption error: %v", err)
+		decryptionFailures.Inc()
+		logger.Error("decryption error", "error", err)
 		return
 	}
 
 	// Parse DNS query
 	msg := new(dns.Msg)
 	if err := msg.Unpack(dnsQuery); err != nil {
-		log.Printf("Failed to parse DNS message: %v", err)
+		logger.Error("failed to parse DNS message", "error", err)
 		return
 	}
 
 	// Log query (no client IP - privacy preserved)
 	if len(msg.Question) > 0 {
-		log.Printf("Resolving: %s %s", msg.Question[0].Name, dns.TypeToString[msg.Question[0].Qtype])
+		qtype := dns.TypeToString[msg.Question[0].Qtype]
+		queriesTotal.WithLabelValues(qtype).Inc()
+		if r.sampler.shouldLog() {
+			logger.Info("resolving", "name", msg.Question[0].Name, "qtype", qtype)
+		}
 	}
 
 	// Resolve DNS query
 	response, err := r.resolveDNS(msg)
 	if err != nil {
-		log.Printf("Resolution error: %v", err)
+		logger.Error("resolution error", "error", err)
 		return
 	}
 
-	// Send response back to proxy
-	responseLen := make([]byte, 2)
-	responseLen[0] = byte(len(response) >> 8)
-	responseLen[1] = byte(len(response))
+	if reply := new(dns.Msg); reply.Unpack(response) == nil {
+		responsesTotal.WithLabelValues(dns.RcodeToString[reply.Rcode]).Inc()
+	}
 
-	if _, err := conn.Write(append(responseLen, response...)); err != nil {
-		log.Printf("Write error: %v", err)
+	if err := writeFrame(conn, writeMu, response); err != nil {
+		logger.Error("write error", "error", err)
 	}
 }
 
-// decryptQuery decrypts an HPKE-encrypted DNS query
+// decryptQuery decrypts an HPKE-encrypted DNS query. It tries every key
+// currently in the key ring, newest first, so a query encrypted against a
+// key that was rotated out (but is still within its grace window) still
+// decrypts.
 func (r *Resolver) decryptQuery(encrypted []byte) ([]byte, error) {
-	// Unmarshal private key
-	skR, err := r.suite.KEM.UnmarshalBinaryPrivateKey(r.config.HPKEPrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal private key: %w", err)
-	}
-
-	// Extract encapsulated key and ciphertext
-	// Format: encapsulated key || ciphertext
 	kemSize := r.suite.KEM.EncapSize()
 	if len(encrypted) < kemSize {
 		return nil, fmt.Errorf("encrypted data too short")
@@ -159,67 +236,109 @@ func (r *Resolver) decryptQuery(encrypted []byte) ([]byte, error) {
 	encapsulatedKey := encrypted[:kemSize]
 	ciphertext := encrypted[kemSize:]
 
-	// Create HPKE receiver
-	receiver, err := r.suite.NewReceiver(skR, nil, encapsulatedKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HPKE receiver: %w", err)
-	}
+	var lastErr error
+	for _, entry := range r.keyRing.snapshot() {
+		skR, err := r.suite.KEM.UnmarshalBinaryPrivateKey(entry.PrivateKey)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to unmarshal private key (epoch %d): %w", entry.Epoch, err)
+			continue
+		}
 
-	// Decrypt query
-	plaintext, err := receiver.Open(ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("HPKE open failed: %w", err)
+		receiver, err := r.suite.NewReceiver(skR, nil, encapsulatedKey)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to create HPKE receiver (epoch %d): %w", entry.Epoch, err)
+			continue
+		}
+
+		plaintext, err := receiver.Open(ciphertext, nil)
+		if err != nil {
+			lastErr = fmt.Errorf("HPKE open failed (epoch %d): %w", entry.Epoch, err)
+			continue
+		}
+
+		return plaintext, nil
 	}
 
-	return plaintext, nil
+	return nil, lastErr
 }
 
-// resolveDNS resolves a DNS query using upstream DNS server
+// resolveDNS resolves a DNS query, consulting the cache (if enabled)
+// before forwarding to upstream and populating it with the result.
 func (r *Resolver) resolveDNS(query *dns.Msg) ([]byte, error) {
-	// Forward to upstream DNS
-	response, _, err := r.client.Exchange(query, r.config.UpstreamDNS)
-	if err != nil {
-		return nil, fmt.Errorf("upstream DNS error: %w", err)
+	if r.cache != nil {
+		if cached, ok := r.cache.Get(query); ok {
+			cacheHits.Inc()
+			return cached.Pack()
+		}
+		cacheMisses.Inc()
 	}
 
-	// Pack response
-	responseBytes, err := response.Pack()
+	response, err := r.resolveUncached(query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pack response: %w", err)
+		return nil, err
+	}
+
+	if r.cache != nil {
+		r.cache.Set(query, response)
 	}
 
-	return responseBytes, nil
+	return response.Pack()
 }
 
-// rotateKeys rotates HPKE keys (called periodically)
-func (r *Resolver) rotateKeys() error {
-	suite, err := hpke.AssembleSuite(KemID, KdfID, AeadID)
-	if err != nil {
-		return fmt.Errorf("failed to assemble HPKE suite: %w", err)
+// resolveUncached performs the actual upstream resolution (with DNS64
+// synthesis where applicable), bypassing the cache.
+func (r *Resolver) resolveUncached(query *dns.Msg) (*dns.Msg, error) {
+	if r.config.DNS64 != nil && len(query.Question) > 0 &&
+		query.Question[0].Qtype == dns.TypeAAAA &&
+		!r.config.DNS64.excluded(query.Question[0].Name) {
+		return r.resolveWithDNS64(query)
 	}
 
-	publicKey, privateKey, err := suite.KEM.GenerateKeyPair()
+	start := time.Now()
+	response, err := r.upstream.exchange(query)
+	upstreamLatency.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("failed to generate key pair: %w", err)
+		return nil, fmt.Errorf("upstream DNS error: %w", err)
 	}
 
-	pkBytes, err := publicKey.MarshalBinary()
+	return response, nil
+}
+
+// refreshCache re-resolves (name, qtype, qclass, do) against upstream and
+// stores the result, used by the cache's prefetch loop to keep hot
+// entries warm before they expire. do must match the DO bit of the cache
+// key being refreshed, since DO is part of the cache key; refreshing
+// with the wrong DO bit would replace an unrelated entry and leave the
+// actual hot one to expire uncached.
+func (r *Resolver) refreshCache(name string, qtype, qclass uint16, do bool) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.Question[0].Qclass = qclass
+	query.SetEdns0(dns.DefaultMsgSize, do)
+
+	response, err := r.resolveUncached(query)
 	if err != nil {
-		return fmt.Errorf("failed to marshal public key: %w", err)
+		logger.Error("prefetch refresh failed", "name", name, "qtype", dns.TypeToString[qtype], "error", err)
+		return
 	}
 
-	skBytes, err := privateKey.MarshalBinary()
+	r.cache.Set(query, response)
+}
+
+// rotateKeys rotates HPKE keys (called periodically). The prior key stays
+// valid for decryption until it ages out of the key ring's grace window;
+// proxies using -config-url pick up the new public key from the
+// ODoHConfigs endpoint without any out-of-band update.
+func (r *Resolver) rotateKeys() error {
+	entry, err := r.keyRing.rotate()
 	if err != nil {
-		return fmt.Errorf("failed to marshal private key: %w", err)
+		return err
 	}
 
-	log.Println("HPKE Keys Rotated")
-	log.Printf("New Public Key: %s", base64.StdEncoding.EncodeToString(pkBytes))
-	log.Printf("New Private Key: %s", base64.StdEncoding.EncodeToString(skBytes))
-	log.Println("Update proxy configuration with new public key")
-
-	// Update resolver's private key
-	r.config.HPKEPrivateKey = skBytes
+	logger.Info("HPKE keys rotated",
+		"epoch", entry.Epoch,
+		"public_key", base64.StdEncoding.EncodeToString(entry.PublicKey),
+		"key_grace_window", r.config.KeyGraceWindow)
 
 	return nil
 }
@@ -230,18 +349,32 @@ func main() {
 	upstream := flag.String("upstream", "1.1.1.1:53", "Upstream DNS server")
 	privkey := flag.String("privkey", "", "HPKE private key (base64)")
 	rotateInterval := flag.Duration("rotate", 24*time.Hour, "Key rotation interval")
+	dns64Prefix := flag.String("dns64-prefix", "", "Enable DNS64 synthesis using this /96 IPv6 prefix (e.g. "+DefaultDNS64Prefix+"); empty disables synthesis")
+	dns64Exclude := flag.String("no-dns64-exclude", "", "Comma-separated AAAA name suffixes that bypass DNS64 synthesis")
+	keyGrace := flag.Duration("key-grace", 10*time.Minute, "How long a rotated-out HPKE key still decrypts in-flight queries")
+	configListen := flag.String("config-listen", "", "Serve ODoHConfigs (RFC 9230) key discovery over HTTPS on this address, e.g. :8443")
+	configCert := flag.String("config-cert", "cert.pem", "TLS certificate for the ODoHConfigs endpoint")
+	configKey := flag.String("config-key", "key.pem", "TLS private key for the ODoHConfigs endpoint")
+	cacheSize := flag.Int("cache-size", 0, "Max cached responses (0 disables the cache)")
+	cacheMinTTL := flag.Duration("cache-min-ttl", 0, "Floor applied to every cached TTL")
+	cacheMaxTTL := flag.Duration("cache-max-ttl", time.Hour, "Ceiling applied to every cached TTL")
+	prefetch := flag.Bool("prefetch", false, "Asynchronously refresh hot cache entries before they expire")
+	metricsListen := flag.String("metrics-listen", "", "Serve Prometheus metrics over HTTPS on this address, e.g. :9854")
+	metricsCert := flag.String("metrics-cert", "cert.pem", "TLS certificate for the metrics endpoint")
+	metricsKey := flag.String("metrics-key", "key.pem", "TLS private key for the metrics endpoint")
+	logSampleRate := flag.Int("log-sample", 1, "Log only 1 in every N queries (1 logs every query)")
 
 	flag.Parse()
 
 	// Validate required parameters
 	if *privkey == "" {
-		log.Fatal("HPKE private key required (use -privkey)")
+		fatal("HPKE private key required (use -privkey)")
 	}
 
 	// Decode private key
 	privkeyBytes, err := base64.StdEncoding.DecodeString(*privkey)
 	if err != nil {
-		log.Fatalf("Invalid private key: %v", err)
+		fatal("invalid private key", "error", err)
 	}
 
 	// Create resolver configuration
@@ -249,12 +382,46 @@ func main() {
 		ListenAddr:     *listen,
 		UpstreamDNS:    *upstream,
 		HPKEPrivateKey: privkeyBytes,
+		KeyGraceWindow: *keyGrace,
+		ConfigListen:   *configListen,
+		ConfigCert:     *configCert,
+		ConfigKey:      *configKey,
+		CacheSize:      *cacheSize,
+		CacheMinTTL:    *cacheMinTTL,
+		CacheMaxTTL:    *cacheMaxTTL,
+		Prefetch:       *prefetch,
+		MetricsListen:  *metricsListen,
+		MetricsCert:    *metricsCert,
+		MetricsKey:     *metricsKey,
+		LogSampleRate:  *logSampleRate,
+	}
+
+	if *dns64Prefix != "" {
+		var exclude []string
+		if *dns64Exclude != "" {
+			exclude = strings.Split(*dns64Exclude, ",")
+		}
+		synth, err := newDNS64Synthesizer(*dns64Prefix, exclude)
+		if err != nil {
+			fatal("invalid DNS64 configuration", "error", err)
+		}
+		config.DNS64 = synth
+		logger.Info("DNS64 synthesis enabled", "prefix", *dns64Prefix, "exclude", exclude)
 	}
 
 	// Create and start resolver
 	resolver, err := NewResolver(config)
 	if err != nil {
-		log.Fatalf("Failed to create resolver: %v", err)
+		fatal("failed to create resolver", "error", err)
+	}
+
+	// Start ODoHConfigs key discovery endpoint
+	if config.ConfigListen != "" {
+		go func() {
+			if err := resolver.startConfigListener(config.ConfigListen, config.ConfigCert, config.ConfigKey); err != nil {
+				fatal("ODoHConfigs listener error", "error", err)
+			}
+		}()
 	}
 
 	// Start key rotation timer
@@ -265,13 +432,21 @@ func main() {
 
 			for range ticker.C {
 				if err := resolver.rotateKeys(); err != nil {
-					log.Printf("Key rotation failed: %v", err)
+					logger.Error("key rotation failed", "error", err)
 				}
 			}
 		}()
 	}
 
+	if config.MetricsListen != "" {
+		go func() {
+			if err := startMetricsListener(config.MetricsListen, config.MetricsCert, config.MetricsKey); err != nil {
+				fatal("metrics listener error", "error", err)
+			}
+		}()
+	}
+
 	if err := resolver.Start(); err != nil {
-		log.Fatalf("Resolver error: %v", err)
+		fatal("resolver error", "error", err)
 	}
 }
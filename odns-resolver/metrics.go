@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are intentionally free of any client-identifying label (no
+// client IP, no per-connection ID): the resolver never sees the client
+// IP in the first place, and labeling by qtype/rcode alone doesn't
+// correlate queries back to a client.
+var (
+	hpkeOpenDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "odns_resolver_hpke_open_duration_seconds",
+		Help: "Time spent decrypting an HPKE-sealed query.",
+	})
+	decryptionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odns_resolver_decryption_failures_total",
+		Help: "Queries that failed to decrypt against every key in the key ring.",
+	})
+	upstreamLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "odns_resolver_upstream_latency_seconds",
+		Help: "Latency of upstream DNS resolution (cache misses only).",
+	})
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "odns_resolver_queries_total",
+		Help: "Queries processed, by query type.",
+	}, []string{"qtype"})
+	responsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "odns_resolver_responses_total",
+		Help: "Responses returned, by response code.",
+	}, []string{"rcode"})
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odns_resolver_cache_hits_total",
+		Help: "Queries answered from the response cache.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "odns_resolver_cache_misses_total",
+		Help: "Queries that missed the response cache.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "odns_resolver_goroutines",
+		Help: "Current number of goroutines.",
+	}, func() float64 { return float64(runtime.NumGoroutine()) })
+)
+
+// startMetricsListener serves Prometheus metrics over HTTPS on
+// listenAddr with the -metrics-cert/-metrics-key pair, which defaults to
+// the same files as the ODoHConfigs endpoint's.
+func startMetricsListener(listenAddr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load metrics TLS certificate: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+		},
+	}
+
+	logger.Info("metrics listener starting", "addr", listenAddr)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// odohConfigVersion is the ObliviousDoHConfig.version this resolver
+	// publishes (RFC 9230 section 4.1).
+	odohConfigVersion = 0x0001
+	// odohConfigMediaType is the content type of the ODoHConfigs response.
+	odohConfigMediaType = "application/odohconfigs"
+	// odohConfigPath is the well-known path clients fetch configs from.
+	odohConfigPath = "/.well-known/odohconfigs"
+)
+
+// marshalODoHConfigs encodes entries as an RFC 9230 section 4.1
+// ObliviousDoHConfigs structure: a 2-byte total length followed by one
+// ObliviousDoHConfig (version, length, contents) per entry, where
+// contents is (kem_id, kdf_id, aead_id, public_key<0..2^16-1>).
+func marshalODoHConfigs(entries []keyRingEntry) []byte {
+	var body []byte
+
+	for _, e := range entries {
+		contents := make([]byte, 6, 8+len(e.PublicKey))
+		binary.BigEndian.PutUint16(contents[0:2], uint16(KemID))
+		binary.BigEndian.PutUint16(contents[2:4], uint16(KdfID))
+		binary.BigEndian.PutUint16(contents[4:6], uint16(AeadID))
+		contents = binary.BigEndian.AppendUint16(contents, uint16(len(e.PublicKey)))
+		contents = append(contents, e.PublicKey...)
+
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], odohConfigVersion)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(contents)))
+
+		body = append(body, header...)
+		body = append(body, contents...)
+	}
+
+	out := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(out, uint16(len(body)))
+	return append(out, body...)
+}
+
+// serveODoHConfigs serves the current ODoHConfigs wire format, including
+// any keys still inside the post-rotation grace window.
+func (r *Resolver) serveODoHConfigs(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", odohConfigMediaType)
+	if _, err := w.Write(marshalODoHConfigs(r.keyRing.snapshot())); err != nil {
+		logger.Error("failed to write odohconfigs response", "error", err)
+	}
+}
+
+// startConfigListener serves ODoHConfigs over HTTPS on listenAddr so
+// proxies can discover (and pick up rotations of) the resolver's HPKE
+// public key without an out-of-band handoff.
+func (r *Resolver) startConfigListener(listenAddr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config TLS certificate: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigPath, r.serveODoHConfigs)
+
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+		},
+	}
+
+	logger.Info("ODoHConfigs endpoint listening", "addr", listenAddr, "path", odohConfigPath)
+	return server.ListenAndServeTLS("", "")
+}
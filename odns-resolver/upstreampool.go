@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: PMPL-1.0-or-later
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxIdleUpstreamConns bounds how many idle keep-alive connections to the
+// upstream DNS server are kept warm between queries.
+const maxIdleUpstreamConns = 32
+
+// upstreamPool maintains a pool of persistent TCP connections to the
+// upstream DNS server, so HPKE's per-query setup cost isn't compounded by
+// a fresh TCP (and, on many resolvers, TLS) handshake on every query.
+type upstreamPool struct {
+	client *dns.Client
+	addr   string
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+// newUpstreamPool creates a pool that dials addr over TCP as needed.
+func newUpstreamPool(addr string, timeout time.Duration) *upstreamPool {
+	return &upstreamPool{
+		client: &dns.Client{
+			Net:     "tcp",
+			Timeout: timeout,
+		},
+		addr: addr,
+	}
+}
+
+// exchange sends query to the upstream server, reusing a pooled
+// connection when one is available and returning it to the pool
+// afterward. A connection that errors is closed rather than reused.
+func (p *upstreamPool) exchange(query *dns.Msg) (*dns.Msg, error) {
+	conn, err := p.get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream: %w", err)
+	}
+
+	resp, _, err := p.client.ExchangeWithConn(query, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.put(conn)
+	return resp, nil
+}
+
+// get returns a pooled connection or dials a new one.
+func (p *upstreamPool) get() (*dns.Conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.client.Dial(p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.Conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+	return conn, nil
+}
+
+// put returns conn to the idle pool, closing it if the pool is full.
+func (p *upstreamPool) put(conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= maxIdleUpstreamConns {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, conn)
+}